@@ -0,0 +1,39 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// DiffNodeNames returns the names of the nodes in before that are no longer
+// present in after, ie. the nodes that were removed. Names that only appear
+// in after are ignored.
+func DiffNodeNames(before, after []v1.Node) []string {
+	afterNames := make(map[string]bool, len(after))
+	for _, node := range after {
+		afterNames[node.ObjectMeta.Name] = true
+	}
+
+	var removed []string
+	for _, node := range before {
+		if !afterNames[node.ObjectMeta.Name] {
+			removed = append(removed, node.ObjectMeta.Name)
+		}
+	}
+	return removed
+}
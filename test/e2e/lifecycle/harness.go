@@ -0,0 +1,205 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lifecycle
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	e2enode "k8s.io/kubernetes/test/e2e/framework/node"
+	e2epod "k8s.io/kubernetes/test/e2e/framework/pod"
+)
+
+// NodeDisruptionHarness bundles the resize/restore ceremony shared by
+// lifecycle e2e tests that intentionally shrink or grow a cluster's node
+// instance group(s) and need to bring the cluster back to full health
+// afterwards. Call Setup in a BeforeEach and Restore in the matching
+// AfterEach; use ShrinkBy and GrowTo from the test body.
+type NodeDisruptionHarness struct {
+	// TunnelDrainDelay is how long Restore waits after resizing before
+	// polling for ready nodes, to let GKE tunnels to disrupted nodes
+	// drop. Setup populates it for GKE and leaves it zero (no wait) for
+	// every other provider.
+	TunnelDrainDelay time.Duration
+
+	f            *framework.Framework
+	groups       []string
+	originalSize int
+	systemPodsNo int32
+}
+
+// Setup records the instance group(s) backing the cluster and the number of
+// system pods currently running, so that Restore later knows what to bring
+// the cluster back to.
+func (h *NodeDisruptionHarness) Setup(f *framework.Framework) {
+	h.f = f
+	h.groups = strings.Split(framework.TestContext.CloudConfig.NodeInstanceGroup, ",")
+	h.originalSize = framework.TestContext.CloudConfig.NumNodes
+	if framework.ProviderIs("gke") {
+		h.TunnelDrainDelay = 5 * time.Minute
+	}
+
+	systemPods, err := e2epod.GetPodsInNamespace(f.ClientSet, metav1.NamespaceSystem, map[string]string{})
+	framework.ExpectNoError(err)
+	h.systemPodsNo = int32(len(systemPods))
+}
+
+// ShrinkBy resizes the instance group(s) down by n nodes in total, waits
+// for the cluster to settle, and returns the nodes that were removed.
+func (h *NodeDisruptionHarness) ShrinkBy(n int) ([]v1.Node, error) {
+	originalNodes := framework.GetReadySchedulableNodesOrDie(h.f.ClientSet)
+
+	if err := resizeGroups(h.groups, -n); err != nil {
+		return nil, err
+	}
+	targetSize := h.originalSize - n
+	if err := e2enode.WaitForReadyNodes(h.f.ClientSet, targetSize, 10*time.Minute); err != nil {
+		return nil, err
+	}
+
+	targetNodes := framework.GetReadySchedulableNodesOrDie(h.f.ClientSet)
+	if len(targetNodes.Items) != targetSize {
+		return nil, fmt.Errorf("expected %d nodes after shrinking, got %d", targetSize, len(targetNodes.Items))
+	}
+
+	removedNames := e2enode.DiffNodeNames(originalNodes.Items, targetNodes.Items)
+	removed := make([]v1.Node, 0, len(removedNames))
+	for _, node := range originalNodes.Items {
+		for _, name := range removedNames {
+			if node.ObjectMeta.Name == name {
+				removed = append(removed, node)
+				break
+			}
+		}
+	}
+	return removed, nil
+}
+
+// GrowTo resizes the instance group(s) up or down to size nodes in total
+// and waits for the cluster to settle.
+func (h *NodeDisruptionHarness) GrowTo(size int) error {
+	current, err := h.groupsSize()
+	if err != nil {
+		return err
+	}
+	if err := resizeGroups(h.groups, size-current); err != nil {
+		return err
+	}
+	return e2enode.WaitForReadyNodes(h.f.ClientSet, size, 10*time.Minute)
+}
+
+// Restore resizes the instance group(s) so that together they again hold
+// the configured number of nodes (CloudConfig.NumNodes), splitting the
+// difference across groups as resizeGroups does; a group is not necessarily
+// returned to its own size at Setup time. It then waits out
+// TunnelDrainDelay and waits for the cluster's nodes and system pods to be
+// healthy again.
+func (h *NodeDisruptionHarness) Restore() error {
+	current, err := h.groupsSize()
+	if err != nil {
+		return fmt.Errorf("couldn't get current node instance group sizes: %v", err)
+	}
+	if err := resizeGroups(h.groups, h.originalSize-current); err != nil {
+		return fmt.Errorf("couldn't restore the original node instance group sizes: %v", err)
+	}
+
+	if h.TunnelDrainDelay > 0 {
+		time.Sleep(h.TunnelDrainDelay)
+	}
+
+	if err := e2enode.WaitForReadyNodes(h.f.ClientSet, h.originalSize, 10*time.Minute); err != nil {
+		return fmt.Errorf("couldn't restore the original cluster size: %v", err)
+	}
+
+	// Many e2e tests assume that the cluster is fully healthy before they start.
+	return e2epod.WaitForPodsRunningReady(h.f.ClientSet, metav1.NamespaceSystem, h.systemPodsNo, 0, framework.PodReadyBeforeTimeout, map[string]string{})
+}
+
+func (h *NodeDisruptionHarness) groupsSize() (int, error) {
+	total := 0
+	for _, group := range h.groups {
+		size, err := framework.GroupSize(group)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't get size of node group %s: %v", group, err)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// resizeGroups resizes every group in groups by an equal share of delta
+// (which may be negative), with any remainder going to the last group, and
+// waits for all of them to reach their new sizes in parallel. If a resize
+// request for any group fails, a resize back to its pre-call size is
+// requested for every group, without waiting for it, before the error is
+// returned. If a group does not reach its new size in time, the error is
+// returned and no group is resized back.
+func resizeGroups(groups []string, delta int) error {
+	originalSizes := make(map[string]int, len(groups))
+	for _, group := range groups {
+		size, err := framework.GroupSize(group)
+		if err != nil {
+			return fmt.Errorf("couldn't get size of node group %s: %v", group, err)
+		}
+		originalSizes[group] = size
+	}
+
+	targetSizes := make(map[string]int32, len(groups))
+	remaining := delta
+	for i, group := range groups {
+		share := delta / len(groups)
+		if i == len(groups)-1 {
+			share = remaining
+		}
+		remaining -= share
+		targetSizes[group] = int32(originalSizes[group] + share)
+	}
+
+	for _, group := range groups {
+		if err := framework.ResizeGroup(group, targetSizes[group]); err != nil {
+			for _, rollbackGroup := range groups {
+				framework.ResizeGroup(rollbackGroup, int32(originalSizes[rollbackGroup]))
+			}
+			return fmt.Errorf("couldn't resize node group %s to %d: %v", group, targetSizes[group], err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(groups))
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group string) {
+			defer wg.Done()
+			if err := framework.WaitForGroupSize(group, targetSizes[group]); err != nil {
+				errs <- fmt.Errorf("node group %s did not reach size %d: %v", group, targetSizes[group], err)
+			}
+		}(group)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,10 +18,10 @@ package lifecycle
 
 import (
 	"fmt"
-	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/test/e2e/framework"
@@ -33,34 +33,29 @@ import (
 	"github.com/onsi/gomega"
 )
 
+// unreachableTaintKey matches the taint the node lifecycle controller applies
+// to a node once its lease stops being renewed and it is marked NotReady.
+const unreachableTaintKey = "node.kubernetes.io/unreachable"
+
 var _ = SIGDescribe("[Disruptive]NodeLease", func() {
 	f := framework.NewDefaultFramework("node-lease-test")
-	var systemPodsNo int32
 	var c clientset.Interface
-	var ns string
-	var group string
 
 	ginkgo.BeforeEach(func() {
 		c = f.ClientSet
-		ns = f.Namespace.Name
-		systemPods, err := e2epod.GetPodsInNamespace(c, ns, map[string]string{})
-		gomega.Expect(err).To(gomega.BeNil())
-		systemPodsNo = int32(len(systemPods))
-		if strings.Index(framework.TestContext.CloudConfig.NodeInstanceGroup, ",") >= 0 {
-			e2elog.Failf("Test dose not support cluster setup with more than one MIG: %s", framework.TestContext.CloudConfig.NodeInstanceGroup)
-		} else {
-			group = framework.TestContext.CloudConfig.NodeInstanceGroup
-		}
 	})
 
 	ginkgo.Describe("NodeLease deletion", func() {
 		var skipped bool
+		var h NodeDisruptionHarness
 
 		ginkgo.BeforeEach(func() {
 			skipped = true
 			framework.SkipUnlessProviderIs("gce", "gke", "aws")
 			framework.SkipUnlessNodeCountIsAtLeast(2)
 			skipped = false
+
+			h.Setup(f)
 		})
 
 		ginkgo.AfterEach(func() {
@@ -68,33 +63,7 @@ var _ = SIGDescribe("[Disruptive]NodeLease", func() {
 				return
 			}
 
-			ginkgo.By("restoring the original node instance group size")
-			if err := framework.ResizeGroup(group, int32(framework.TestContext.CloudConfig.NumNodes)); err != nil {
-				e2elog.Failf("Couldn't restore the original node instance group size: %v", err)
-			}
-			// In GKE, our current tunneling setup has the potential to hold on to a broken tunnel (from a
-			// rebooted/deleted node) for up to 5 minutes before all tunnels are dropped and recreated.
-			// Most tests make use of some proxy feature to verify functionality. So, if a reboot test runs
-			// right before a test that tries to get logs, for example, we may get unlucky and try to use a
-			// closed tunnel to a node that was recently rebooted. There's no good way to framework.Poll for proxies
-			// being closed, so we sleep.
-			//
-			// TODO(cjcullen) reduce this sleep (#19314)
-			if framework.ProviderIs("gke") {
-				ginkgo.By("waiting 5 minutes for all dead tunnels to be dropped")
-				time.Sleep(5 * time.Minute)
-			}
-			if err := framework.WaitForGroupSize(group, int32(framework.TestContext.CloudConfig.NumNodes)); err != nil {
-				e2elog.Failf("Couldn't restore the original node instance group size: %v", err)
-			}
-
-			if err := e2enode.WaitForReadyNodes(c, framework.TestContext.CloudConfig.NumNodes, 10*time.Minute); err != nil {
-				e2elog.Failf("Couldn't restore the original cluster size: %v", err)
-			}
-			// Many e2e tests assume that the cluster is fully healthy before they start.  Wait until
-			// the cluster is restored to health.
-			ginkgo.By("waiting for system pods to successfully restart")
-			err := e2epod.WaitForPodsRunningReady(c, metav1.NamespaceSystem, systemPodsNo, 0, framework.PodReadyBeforeTimeout, map[string]string{})
+			err := h.Restore()
 			gomega.Expect(err).To(gomega.BeNil())
 		})
 
@@ -121,36 +90,26 @@ var _ = SIGDescribe("[Disruptive]NodeLease", func() {
 				return fmt.Errorf("some node lease is not ready")
 			}, 1*time.Minute, 5*time.Second).Should(gomega.BeNil())
 
-			targetNumNodes := int32(framework.TestContext.CloudConfig.NumNodes - 1)
-			ginkgo.By(fmt.Sprintf("decreasing cluster size to %d", targetNumNodes))
-			err = framework.ResizeGroup(group, targetNumNodes)
+			leasesBefore, err := leaseClient.List(metav1.ListOptions{})
 			gomega.Expect(err).To(gomega.BeNil())
-			err = framework.WaitForGroupSize(group, targetNumNodes)
-			gomega.Expect(err).To(gomega.BeNil())
-			err = e2enode.WaitForReadyNodes(c, framework.TestContext.CloudConfig.NumNodes-1, 10*time.Minute)
+
+			ginkgo.By(fmt.Sprintf("decreasing size of each of the %d node group(s) by one node", len(h.groups)))
+			deletedNodes, err := h.ShrinkBy(len(h.groups))
 			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(deletedNodes)).To(gomega.Equal(len(h.groups)))
+
 			targetNodes := framework.GetReadySchedulableNodesOrDie(c)
-			framework.ExpectEqual(len(targetNodes.Items), int(targetNumNodes))
-
-			ginkgo.By("verify node lease is deleted for the deleted node")
-			var deletedNodeName string
-			for _, originalNode := range originalNodes.Items {
-				originalNodeName := originalNode.ObjectMeta.Name
-				for _, targetNode := range targetNodes.Items {
-					if originalNodeName == targetNode.ObjectMeta.Name {
-						continue
+
+			ginkgo.By("verify node lease is deleted for every deleted node")
+			for _, deletedNode := range deletedNodes {
+				deletedNodeName := deletedNode.ObjectMeta.Name
+				gomega.Eventually(func() error {
+					if _, err := leaseClient.Get(deletedNodeName, metav1.GetOptions{}); err == nil {
+						return fmt.Errorf("node lease is not deleted yet for node %q", deletedNodeName)
 					}
-				}
-				deletedNodeName = originalNodeName
-				break
+					return nil
+				}, 1*time.Minute, 5*time.Second).Should(gomega.BeNil())
 			}
-			gomega.Expect(deletedNodeName).NotTo(gomega.Equal(""))
-			gomega.Eventually(func() error {
-				if _, err := leaseClient.Get(deletedNodeName, metav1.GetOptions{}); err == nil {
-					return fmt.Errorf("node lease is not deleted yet for node %q", deletedNodeName)
-				}
-				return nil
-			}, 1*time.Minute, 5*time.Second).Should(gomega.BeNil())
 
 			ginkgo.By("verify node leases still exist for remaining nodes")
 			gomega.Eventually(func() error {
@@ -161,6 +120,145 @@ var _ = SIGDescribe("[Disruptive]NodeLease", func() {
 				}
 				return nil
 			}, 1*time.Minute, 5*time.Second).Should(gomega.BeNil())
+
+			ginkgo.By("verify no spurious lease deletions occurred for surviving nodes")
+			deletedNames := make(map[string]bool, len(deletedNodes))
+			for _, node := range deletedNodes {
+				deletedNames[node.ObjectMeta.Name] = true
+			}
+			leasesAfter, err := leaseClient.List(metav1.ListOptions{})
+			gomega.Expect(err).To(gomega.BeNil())
+			leaseExistsAfter := make(map[string]bool, len(leasesAfter.Items))
+			for _, lease := range leasesAfter.Items {
+				leaseExistsAfter[lease.ObjectMeta.Name] = true
+			}
+			for _, lease := range leasesBefore.Items {
+				if deletedNames[lease.ObjectMeta.Name] {
+					continue
+				}
+				framework.ExpectEqual(leaseExistsAfter[lease.ObjectMeta.Name], true)
+			}
+		})
+	})
+
+	ginkgo.Describe("NodeLease renewal", func() {
+		var skipped bool
+		var targetNode v1.Node
+
+		ginkgo.BeforeEach(func() {
+			skipped = true
+			framework.SkipUnlessProviderIs("gce", "gke", "aws")
+			framework.SkipUnlessSSHKeyPresent()
+			skipped = false
+
+			nodes := framework.GetReadySchedulableNodesOrDie(c)
+			framework.ExpectEqual(len(nodes.Items) > 0, true)
+			targetNode = nodes.Items[0]
+		})
+
+		ginkgo.AfterEach(func() {
+			if skipped {
+				return
+			}
+
+			ginkgo.By(fmt.Sprintf("restarting the kubelet on node %s", targetNode.ObjectMeta.Name))
+			_, err := framework.IssueSSHCommandWithResult("sudo systemctl start kubelet", framework.TestContext.Provider, &targetNode)
+			gomega.Expect(err).To(gomega.BeNil())
+
+			ginkgo.By("waiting for the lease to resume renewing")
+			leaseClient := c.CoordinationV1().Leases(v1.NamespaceNodeLease)
+			gomega.Eventually(func() error {
+				lease, err := leaseClient.Get(targetNode.ObjectMeta.Name, metav1.GetOptions{})
+				if err != nil {
+					return err
+				}
+				if lease.Spec.RenewTime == nil || lease.Spec.RenewTime.Add(2*time.Minute).Before(time.Now()) {
+					return fmt.Errorf("lease for node %q is still stale", targetNode.ObjectMeta.Name)
+				}
+				return nil
+			}, 5*time.Minute, 10*time.Second).Should(gomega.BeNil())
+
+			err = e2enode.WaitForNodeToBeReady(c, targetNode.ObjectMeta.Name, 5*time.Minute)
+			gomega.Expect(err).To(gomega.BeNil())
+		})
+
+		ginkgo.It("should evict a pod without a long-lived toleration once lease renewal stops, while a pod relying on the default toleration rides out the grace period", func() {
+			ns := f.Namespace.Name
+			evictedPodName := "lease-renewal-evicted-pod"
+			tolerantPodName := "lease-renewal-tolerant-pod"
+
+			evictedPod := e2epod.NewAgnhostPod(ns, evictedPodName, nil, nil, nil)
+			evictedPod.Spec.NodeName = targetNode.ObjectMeta.Name
+			// Tolerate the unreachable taint for 0 seconds so eviction is
+			// requested as soon as the taint is applied, instead of riding
+			// out the apiserver's 300s DefaultTolerationSeconds admission
+			// default like a pod with no toleration of its own would.
+			zeroTolerationSeconds := int64(0)
+			evictedPod.Spec.Tolerations = []v1.Toleration{
+				{
+					Key:               unreachableTaintKey,
+					Operator:          v1.TolerationOpExists,
+					Effect:            v1.TaintEffectNoExecute,
+					TolerationSeconds: &zeroTolerationSeconds,
+				},
+			}
+			f.PodClient().CreateSync(evictedPod)
+
+			// tolerantPod has no toleration of its own, so the
+			// DefaultTolerationSeconds admission plugin gives it a 300s
+			// unreachable/not-ready toleration; it stands for a pod that
+			// declares no toleration and should still be running well
+			// within the window this test polls.
+			tolerantPod := e2epod.NewAgnhostPod(ns, tolerantPodName, nil, nil, nil)
+			tolerantPod.Spec.NodeName = targetNode.ObjectMeta.Name
+			f.PodClient().CreateSync(tolerantPod)
+
+			ginkgo.By(fmt.Sprintf("stopping the kubelet on node %s", targetNode.ObjectMeta.Name))
+			_, err := framework.IssueSSHCommandWithResult("sudo systemctl stop kubelet", framework.TestContext.Provider, &targetNode)
+			gomega.Expect(err).To(gomega.BeNil())
+
+			ginkgo.By("waiting for the node to become NotReady")
+			err = e2enode.WaitForNodeToBeNotReady(c, targetNode.ObjectMeta.Name, 5*time.Minute)
+			gomega.Expect(err).To(gomega.BeNil())
+
+			ginkgo.By("verifying the unreachable:NoExecute taint is applied")
+			gomega.Eventually(func() error {
+				node, err := c.CoreV1().Nodes().Get(targetNode.ObjectMeta.Name, metav1.GetOptions{})
+				if err != nil {
+					return err
+				}
+				for _, taint := range node.Spec.Taints {
+					if taint.Key == unreachableTaintKey && taint.Effect == v1.TaintEffectNoExecute {
+						return nil
+					}
+				}
+				return fmt.Errorf("node %q is missing the %s:NoExecute taint", targetNode.ObjectMeta.Name, unreachableTaintKey)
+			}, 2*time.Minute, 5*time.Second).Should(gomega.BeNil())
+
+			// The kubelet is dead, so there's nothing left on the node to
+			// finalize the pod: a graceful eviction can only get as far as
+			// setting DeletionTimestamp, and the pod won't actually be
+			// removed from the API until the node itself is deleted. Accept
+			// either outcome as proof eviction was requested.
+			ginkgo.By("verifying eviction was requested for the pod with a 0-second toleration")
+			gomega.Eventually(func() error {
+				evictedPodGot, err := c.CoreV1().Pods(ns).Get(evictedPodName, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if evictedPodGot.ObjectMeta.DeletionTimestamp == nil {
+					return fmt.Errorf("pod %q has not been marked for eviction yet", evictedPodName)
+				}
+				return nil
+			}, 2*time.Minute, 5*time.Second).Should(gomega.BeNil())
+
+			ginkgo.By("verifying the pod relying on DefaultTolerationSeconds has not been evicted yet")
+			tolerantPodGot, err := c.CoreV1().Pods(ns).Get(tolerantPodName, metav1.GetOptions{})
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(tolerantPodGot.ObjectMeta.DeletionTimestamp).To(gomega.BeNil())
 		})
 	})
-})
\ No newline at end of file
+})